@@ -0,0 +1,274 @@
+// Copyright 2017 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+// Command reflowlet serves a reflow pool over HTTP(S). It is the
+// documented entry point for the reflowlet server; see
+// reflowlet.Server for the underlying implementation and AddFlags
+// for the older flag.FlagSet-based entry point kept for compatibility.
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+
+	"github.com/grailbio/reflow/config"
+	"github.com/grailbio/reflow/log"
+	"github.com/grailbio/reflow/reflowlet"
+)
+
+// configSection is the key under which reflowlet's own settings
+// (addr, dir, ndigest, ...) live in the Reflow config file.
+//
+// These settings are resolved through this package's own viper
+// precedence layer, not through config.Config's Keys()/Marshal/
+// Unmarshal registry: that registry is a set of named providers (aws,
+// https, ...) shared across every Reflow binary, and reflowlet's
+// settings aren't a provider of that shape. Namespacing them under
+// "reflowlet:" just keeps this section from colliding with the config
+// keyspace's own top-level keys (e.g. "aws", "https") when both are
+// read out of the same file by check-config.
+const configSection = "reflowlet"
+
+func getString(v *viper.Viper, name string) string { return v.GetString(configSection + "." + name) }
+
+func getInt(v *viper.Viper, name string) int { return v.GetInt(configSection + "." + name) }
+
+func getBool(v *viper.Viper, name string) bool { return v.GetBool(configSection + "." + name) }
+
+func getDuration(v *viper.Viper, name string) time.Duration {
+	return v.GetDuration(configSection + "." + name)
+}
+
+// idlePolicy builds the reflowlet.IdlePolicy named by mode from the
+// serve command's idle-policy flags.
+func idlePolicy(v *viper.Viper, mode string) (reflowlet.IdlePolicy, error) {
+	switch mode {
+	case "", "fixed":
+		return reflowlet.FixedExpiry{Expiry: getDuration(v, "idleexpiry")}, nil
+	case "billing-aligned":
+		return &reflowlet.BillingAligned{
+			Period:  getDuration(v, "billingperiod"),
+			Margin:  getDuration(v, "billingmargin"),
+			MinIdle: time.Minute,
+		}, nil
+	case "load-adaptive":
+		return &reflowlet.LoadAdaptive{
+			BaseExpiry: getDuration(v, "idleexpiry"),
+			MaxExpiry:  getDuration(v, "idlemaxexpiry"),
+			Window:     getDuration(v, "idlewindow"),
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown idle policy %q", mode)
+	}
+}
+
+// envPrefix is prepended to the upper-cased flag name to derive the
+// environment variable consulted for that flag, e.g. the "addr" flag
+// is also settable via REFLOWLET_ADDR.
+const envPrefix = "REFLOWLET"
+
+// version is overridden via -ldflags "-X main.version=..." at release
+// build time.
+var version = "dev"
+
+// srv is the server configured by the serve command. check-config
+// does not use it; it validates the config file through its own
+// config.Config instead.
+var srv reflowlet.Server
+
+func main() {
+	if err := newRootCmd().Execute(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func newRootCmd() *cobra.Command {
+	root := &cobra.Command{
+		Use:           "reflowlet",
+		Short:         "reflowlet serves a local reflow pool over HTTP(S)",
+		SilenceUsage:  true,
+		SilenceErrors: true,
+	}
+	root.AddCommand(newServeCmd(), newCheckConfigCmd(), newVersionCmd())
+	return root
+}
+
+// bindFlags resolves precedence for every flag in cmd, other than
+// "config" itself: explicit flags take priority, then the
+// REFLOWLET_* environment variable, then the "reflowlet" section of
+// the config file merged by mergeConfigFile, then the flag's own
+// default. Each flag is bound under its configSection-qualified key
+// so a "reflowlet:" section in the Reflow config file can set it
+// without colliding with the config keyspace's own top-level keys.
+func bindFlags(cmd *cobra.Command, v *viper.Viper) {
+	cmd.Flags().VisitAll(func(f *pflag.Flag) {
+		if f.Name == "config" {
+			_ = v.BindPFlag(f.Name, f)
+			return
+		}
+		key := configSection + "." + f.Name
+		envVar := envPrefix + "_" + strings.ToUpper(strings.Replace(f.Name, "-", "_", -1))
+		_ = v.BindEnv(key, envVar)
+		_ = v.BindPFlag(key, f)
+	})
+}
+
+// mergeConfigFile loads path (if non-empty) into v, so that the keys
+// under its "reflowlet:" section (addr, dir, etc.) participate in the
+// flag/env/file/default precedence resolved by bindFlags.
+func mergeConfigFile(v *viper.Viper, path string) error {
+	if path == "" {
+		return nil
+	}
+	v.SetConfigFile(path)
+	v.SetConfigType("yaml")
+	if err := v.MergeInConfig(); err != nil {
+		return fmt.Errorf("reading config file %s: %v", path, err)
+	}
+	return nil
+}
+
+func addServeFlags(flags *pflag.FlagSet) {
+	flags.String("config", "", "the Reflow configuration file")
+	flags.String("addr", ":9000", "HTTPS server address")
+	flags.String("prefix", "", "prefix used for directory lookup")
+	flags.Bool("insecure", false, "listen on HTTP, not HTTPS")
+	flags.String("dir", "/mnt/data/reflow", "runtime data directory")
+	flags.Int("ndigest", 32, "number of allowable concurrent digest ops")
+	flags.Bool("ec2cluster", false, "this reflowlet is part of an ec2cluster")
+	flags.Bool("httpdebug", false, "turn on HTTP debug logging")
+	flags.String("certmode", "", `how to obtain the server's TLS certificate: "" (static), "acme-staging", or "acme-production"`)
+	flags.String("acmehosts", "", "comma-separated DNS names to provision ACME certificates for")
+	flags.Bool("acmerequireclientcert", false, "also require a verified client certificate on ACME-provisioned listeners; breaks the TLS-ALPN-01 challenge, so only use it with out-of-band ACME issuance")
+	flags.Int("streambufsize", 0, "frame/buffer size, in bytes, for the exec-log and flow-event streaming endpoints (0 uses the server default)")
+	flags.String("idlepolicy", "fixed", `ec2cluster idle-shutdown policy: "fixed" (default), "billing-aligned", or "load-adaptive"`)
+	flags.Duration("idleexpiry", 10*time.Minute, `base idle expiry for the "fixed" and "load-adaptive" idle policies`)
+	flags.Duration("idlemaxexpiry", time.Hour, `maximum idle expiry for the "load-adaptive" idle policy`)
+	flags.Duration("idlewindow", 10*time.Minute, `recent-throughput window for the "load-adaptive" idle policy`)
+	flags.Duration("billingperiod", time.Hour, `billing increment for the "billing-aligned" idle policy`)
+	flags.Duration("billingmargin", 5*time.Minute, `how close to the next billing tick the "billing-aligned" idle policy waits for before allowing shutdown`)
+	flags.Duration("draintimeout", 10*time.Minute, "how long an idle ec2cluster reflowlet waits for in-flight execs before shutting down regardless")
+}
+
+func newServeCmd() *cobra.Command {
+	v := viper.New()
+	cmd := &cobra.Command{
+		Use:   "serve",
+		Short: "start the reflowlet server",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := mergeConfigFile(v, v.GetString("config")); err != nil {
+				return err
+			}
+			srv.SetConfigFile(v.GetString("config"))
+			srv.Addr = getString(v, "addr")
+			srv.Prefix = getString(v, "prefix")
+			srv.Insecure = getBool(v, "insecure")
+			srv.Dir = getString(v, "dir")
+			srv.NDigest = getInt(v, "ndigest")
+			srv.EC2Cluster = getBool(v, "ec2cluster")
+			srv.HTTPDebug = getBool(v, "httpdebug")
+			srv.StreamBufferSize = getInt(v, "streambufsize")
+			srv.DrainTimeout = getDuration(v, "draintimeout")
+			policy, err := idlePolicy(v, getString(v, "idlepolicy"))
+			if err != nil {
+				return err
+			}
+			srv.IdlePolicy = policy
+			if mode := getString(v, "certmode"); mode != "" {
+				if err := srv.CertMode.Set(mode); err != nil {
+					return err
+				}
+			}
+			if hosts := getString(v, "acmehosts"); hosts != "" {
+				srv.ACMEHosts = strings.Split(hosts, ",")
+			}
+			srv.ACMERequireClientCert = getBool(v, "acmerequireclientcert")
+			return srv.ListenAndServe()
+		},
+	}
+	addServeFlags(cmd.Flags())
+	bindFlags(cmd, v)
+	return cmd
+}
+
+func newCheckConfigCmd() *cobra.Command {
+	v := viper.New()
+	cmd := &cobra.Command{
+		Use:   "check-config",
+		Short: "validate a Reflow configuration file without starting the server",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			path := v.GetString("config")
+			if path == "" {
+				return fmt.Errorf("check-config: -config is required")
+			}
+			if err := mergeConfigFile(v, path); err != nil {
+				return err
+			}
+			if addr := getString(v, "addr"); addr != "" {
+				if _, _, err := net.SplitHostPort(addr); err != nil {
+					return fmt.Errorf("check-config: reflowlet.addr: %v", err)
+				}
+			}
+			if ndigest := getInt(v, "ndigest"); ndigest <= 0 {
+				return fmt.Errorf("check-config: reflowlet.ndigest must be positive, got %d", ndigest)
+			}
+			if _, err := idlePolicy(v, getString(v, "idlepolicy")); err != nil {
+				return fmt.Errorf("check-config: %v", err)
+			}
+			if mode := getString(v, "certmode"); mode != "" {
+				var m reflowlet.CertMode
+				if err := m.Set(mode); err != nil {
+					return fmt.Errorf("check-config: reflowlet.certmode: %v", err)
+				}
+				if getString(v, "acmehosts") == "" {
+					return fmt.Errorf("check-config: reflowlet.acmehosts must be set when reflowlet.certmode=%s", mode)
+				}
+			}
+
+			b, err := ioutil.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			cfg, err := config.Make(nil)
+			if err != nil {
+				return err
+			}
+			if err := config.Unmarshal(b, cfg.Keys()); err != nil {
+				return err
+			}
+			if cfg, err = config.Make(cfg); err != nil {
+				return fmt.Errorf("check-config: %v", err)
+			}
+			if _, err := cfg.AWS(); err != nil {
+				return fmt.Errorf("check-config: aws: %v", err)
+			}
+			if _, _, err := cfg.HTTPS(); err != nil {
+				return fmt.Errorf("check-config: https: %v", err)
+			}
+			fmt.Fprintln(cmd.OutOrStdout(), "config OK")
+			return nil
+		},
+	}
+	addServeFlags(cmd.Flags())
+	bindFlags(cmd, v)
+	return cmd
+}
+
+func newVersionCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "version",
+		Short: "print the reflowlet version",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			fmt.Fprintln(cmd.OutOrStdout(), version)
+			return nil
+		},
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright 2017 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package reflowlet
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+
+	"github.com/grailbio/reflow/log"
+	"github.com/grailbio/reflow/reflowlet/certstore"
+)
+
+// CertMode determines how a Server obtains the TLS certificate it
+// serves.
+type CertMode string
+
+const (
+	// CertModeStatic uses the pre-provisioned certificate returned by
+	// Config.HTTPS, as reflowlet has always done. It is the default.
+	CertModeStatic CertMode = ""
+	// CertModeACMEStaging provisions certificates from the Let's
+	// Encrypt staging directory. Staging certificates are not
+	// trusted by ordinary clients, but the directory has much higher
+	// rate limits, so it's the right choice while exercising the
+	// ACME integration itself.
+	CertModeACMEStaging CertMode = "acme-staging"
+	// CertModeACMEProduction provisions trusted certificates from the
+	// Let's Encrypt production directory.
+	CertModeACMEProduction CertMode = "acme-production"
+)
+
+const acmeStagingDirectory = "https://acme-staging-v02.api.letsencrypt.org/directory"
+
+// renewBefore is how long before a certificate's expiry the
+// background renewer in renewLoop attempts to replace it.
+const renewBefore = 30 * 24 * time.Hour
+
+// acmeTLSConfig returns a *tls.Config that serves certificates for
+// hosts provisioned via ACME (RFC 8555), using store to persist the
+// ACME account key and issued certificate chains. It also starts a
+// background goroutine that keeps the cached certificates renewed
+// roughly renewBefore their expiry, so that a handshake is never the
+// first thing to discover a certificate needs replacing.
+func acmeTLSConfig(mode CertMode, hosts []string, store certstore.Store) (*tls.Config, error) {
+	var directory string
+	switch mode {
+	case CertModeACMEStaging:
+		directory = acmeStagingDirectory
+	case CertModeACMEProduction:
+		directory = acme.LetsEncryptURL
+	default:
+		return nil, fmt.Errorf("acmeTLSConfig: unsupported cert mode %q", mode)
+	}
+	if len(hosts) == 0 {
+		return nil, fmt.Errorf("acmeTLSConfig: no hosts configured for ACME provisioning")
+	}
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(hosts...),
+		Cache:      certCache{store},
+		Client:     &acme.Client{DirectoryURL: directory},
+	}
+	go renewLoop(m, hosts)
+	return m.TLSConfig(), nil
+}
+
+// renewLoop periodically checks the certificates cached for hosts
+// and logs (and triggers, via GetCertificate) a renewal once a
+// certificate is within renewBefore of expiring.
+func renewLoop(m *autocert.Manager, hosts []string) {
+	for {
+		time.Sleep(time.Hour)
+		for _, host := range hosts {
+			cert, err := m.GetCertificate(&tls.ClientHelloInfo{ServerName: host})
+			if err != nil {
+				log.Errorf("acme: renew check for %s: %v", host, err)
+				continue
+			}
+			if cert.Leaf != nil && time.Until(cert.Leaf.NotAfter) < renewBefore {
+				log.Printf("acme: cert for %s expires %s; renewing", host, cert.Leaf.NotAfter)
+			}
+		}
+	}
+}
+
+// certCache adapts a certstore.Store to the autocert.Cache interface
+// expected by autocert.Manager.
+type certCache struct {
+	store certstore.Store
+}
+
+func (c certCache) Get(ctx context.Context, key string) ([]byte, error) {
+	b, err := c.store.Get(ctx, key)
+	if err != nil {
+		return nil, autocert.ErrCacheMiss
+	}
+	return b, nil
+}
+
+func (c certCache) Put(ctx context.Context, key string, data []byte) error {
+	return c.store.Put(ctx, key, data)
+}
+
+func (c certCache) Delete(ctx context.Context, key string) error {
+	return c.store.Delete(ctx, key)
+}
@@ -0,0 +1,25 @@
+// Copyright 2017 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+// Package certstore defines pluggable storage backends for ACME
+// account keys and issued certificate chains, so that the reflowlets
+// in an EC2Cluster can share a single provisioned certificate instead
+// of each instance obtaining (and rate-limiting against) its own.
+package certstore
+
+import "context"
+
+// Store is a small key-value interface for persisting opaque ACME
+// cache entries (account keys, certificate chains). Its shape
+// mirrors golang.org/x/crypto/acme/autocert.Cache so that
+// implementations can be adapted to it directly.
+type Store interface {
+	// Get returns the value stored under key. It returns an error if
+	// no value is stored under key.
+	Get(ctx context.Context, key string) ([]byte, error)
+	// Put stores value under key, overwriting any previous value.
+	Put(ctx context.Context, key string, value []byte) error
+	// Delete removes the value stored under key, if any.
+	Delete(ctx context.Context, key string) error
+}
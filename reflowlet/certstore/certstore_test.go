@@ -0,0 +1,162 @@
+// Copyright 2017 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package certstore
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+func TestFileRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := File(filepath.Join(dir, "acme"))
+	ctx := context.Background()
+
+	if _, err := store.Get(ctx, "cert"); err == nil {
+		t.Fatal("Get of missing key: expected error, got nil")
+	}
+
+	want := []byte("leaf+intermediates")
+	if err := store.Put(ctx, "cert", want); err != nil {
+		t.Fatal(err)
+	}
+	got, err := store.Get(ctx, "cert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	if err := store.Delete(ctx, "cert"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get(ctx, "cert"); err == nil {
+		t.Fatal("Get after Delete: expected error, got nil")
+	}
+
+	// Deleting an already-missing key is not an error.
+	if err := store.Delete(ctx, "cert"); err != nil {
+		t.Errorf("Delete of missing key: got %v, want nil", err)
+	}
+}
+
+// fakeS3 is an in-memory stand-in for the handful of S3 operations
+// certstore.S3 needs. It embeds s3iface.S3API so that it satisfies the
+// full interface without implementing the hundred-odd methods
+// certstore never calls.
+type fakeS3 struct {
+	s3iface.S3API
+
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{objects: make(map[string][]byte)}
+}
+
+func (f *fakeS3) GetObjectWithContext(ctx aws.Context, in *s3.GetObjectInput, _ ...request.Option) (*s3.GetObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	b, ok := f.objects[aws.StringValue(in.Bucket)+"/"+aws.StringValue(in.Key)]
+	if !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchKey, "no such key", nil)
+	}
+	return &s3.GetObjectOutput{Body: ioutil.NopCloser(bytes.NewReader(b))}, nil
+}
+
+func (f *fakeS3) PutObjectWithContext(ctx aws.Context, in *s3.PutObjectInput, _ ...request.Option) (*s3.PutObjectOutput, error) {
+	b, err := ioutil.ReadAll(in.Body)
+	if err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	f.objects[aws.StringValue(in.Bucket)+"/"+aws.StringValue(in.Key)] = b
+	f.mu.Unlock()
+	return &s3.PutObjectOutput{}, nil
+}
+
+func (f *fakeS3) DeleteObjectWithContext(ctx aws.Context, in *s3.DeleteObjectInput, _ ...request.Option) (*s3.DeleteObjectOutput, error) {
+	f.mu.Lock()
+	delete(f.objects, aws.StringValue(in.Bucket)+"/"+aws.StringValue(in.Key))
+	f.mu.Unlock()
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+// raw returns the bytes stored under bucket/key with no gzip
+// decompression, so tests can assert on the wire format directly.
+func (f *fakeS3) raw(bucket, key string) ([]byte, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	b, ok := f.objects[bucket+"/"+key]
+	return b, ok
+}
+
+func TestS3RoundTrip(t *testing.T) {
+	fake := newFakeS3()
+	store := S3{Bucket: "bucket", Prefix: "acme/", Client: fake}
+	ctx := context.Background()
+
+	if _, err := store.Get(ctx, "cert"); err == nil {
+		t.Fatal("Get of missing key: expected error, got nil")
+	}
+
+	want := []byte("leaf+intermediates")
+	if err := store.Put(ctx, "cert", want); err != nil {
+		t.Fatal(err)
+	}
+	got, err := store.Get(ctx, "cert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// The value is stored gzip-compressed, not as plain bytes.
+	raw, ok := fake.raw("bucket", "acme/cert")
+	if !ok {
+		t.Fatal("no object stored under bucket/acme/cert")
+	}
+	if bytes.Equal(raw, want) {
+		t.Error("stored object is not compressed")
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("stored object is not valid gzip: %v", err)
+	}
+	decompressed, err := ioutil.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decompressed, want) {
+		t.Errorf("decompressed %q, want %q", decompressed, want)
+	}
+
+	if err := store.Delete(ctx, "cert"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get(ctx, "cert"); err == nil {
+		t.Fatal("Get after Delete: expected error, got nil")
+	}
+}
@@ -0,0 +1,44 @@
+// Copyright 2017 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package certstore
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// File is a Store backed by a local directory. It is the default
+// backend for reflowlets that are not part of an EC2Cluster, where
+// there is no need to share certificates across instances.
+type File string
+
+// Get implements Store.
+func (d File) Get(ctx context.Context, key string) ([]byte, error) {
+	return ioutil.ReadFile(filepath.Join(string(d), key))
+}
+
+// Put implements Store.
+func (d File) Put(ctx context.Context, key string, value []byte) error {
+	if err := os.MkdirAll(string(d), 0700); err != nil {
+		return err
+	}
+	name := filepath.Join(string(d), key)
+	tmp := name + ".tmp"
+	if err := ioutil.WriteFile(tmp, value, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
+}
+
+// Delete implements Store.
+func (d File) Delete(ctx context.Context, key string) error {
+	err := os.Remove(filepath.Join(string(d), key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
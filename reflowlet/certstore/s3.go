@@ -0,0 +1,80 @@
+// Copyright 2017 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package certstore
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// S3 is a Store backed by an S3 bucket and key prefix, so that an
+// EC2Cluster's reflowlets can share a single ACME-issued certificate.
+// Values are gzip-compressed before being written: a full ACME chain
+// (leaf plus intermediates) routinely exceeds 16KB, which is enough
+// to blow through the per-item size limits of some of the small KV
+// backends reflow otherwise targets.
+type S3 struct {
+	Bucket string
+	Prefix string
+	// Client is the S3 client used to read and write cache entries.
+	// It is an interface, rather than the concrete *s3.S3, so that
+	// tests can supply a fake.
+	Client s3iface.S3API
+}
+
+func (s S3) key(key string) string {
+	return s.Prefix + key
+}
+
+// Get implements Store.
+func (s S3) Get(ctx context.Context, key string) ([]byte, error) {
+	out, err := s.Client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(s.key(key)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer out.Body.Close()
+	gz, err := gzip.NewReader(out.Body)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+	return ioutil.ReadAll(gz)
+}
+
+// Put implements Store.
+func (s S3) Put(ctx context.Context, key string, value []byte) error {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write(value); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	_, err := s.Client.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(s.key(key)),
+		Body:   bytes.NewReader(buf.Bytes()),
+	})
+	return err
+}
+
+// Delete implements Store.
+func (s S3) Delete(ctx context.Context, key string) error {
+	_, err := s.Client.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(s.key(key)),
+	})
+	return err
+}
@@ -0,0 +1,205 @@
+// Copyright 2017 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package reflowlet
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/grailbio/base/digest"
+	"github.com/grailbio/reflow"
+	"github.com/grailbio/reflow/local"
+)
+
+// drainingExecutor wraps a *local.Pool so that an EC2Cluster
+// reflowlet can stop accepting new execs once its IdlePolicy decides
+// to shut down, while letting in-flight execs that were already
+// accepted keep running. It also tracks its own Put history, which
+// IdlePolicy implementations and the drain loop use in place of
+// p.Execs() (which returns every exec the pool has ever known about,
+// not just the ones still running or recently submitted).
+type drainingExecutor struct {
+	*local.Pool
+	draining int32
+	inFlight int32
+
+	mu   sync.Mutex
+	puts []time.Time
+}
+
+func (d *drainingExecutor) startDraining() {
+	atomic.StoreInt32(&d.draining, 1)
+}
+
+// Put overrides local.Pool's Put, rejecting new execs once draining,
+// and records enough bookkeeping (submission time, in-flight count)
+// for RecentPuts and InFlight to answer without consulting the pool's
+// own, unbounded exec registry.
+func (d *drainingExecutor) Put(ctx context.Context, id digest.Digest, execCfg reflow.ExecConfig) (reflow.Exec, error) {
+	if atomic.LoadInt32(&d.draining) != 0 {
+		return nil, errors.New("reflowlet: draining, not accepting new execs")
+	}
+	e, err := d.Pool.Put(ctx, id, execCfg)
+	if err != nil {
+		return nil, err
+	}
+	d.mu.Lock()
+	d.puts = append(d.puts, time.Now())
+	d.mu.Unlock()
+	atomic.AddInt32(&d.inFlight, 1)
+	go func() {
+		// Result blocks until e completes, successfully or not, which
+		// is how we learn it's no longer in flight without re-deriving
+		// "still running" from exec state ourselves.
+		_, _ = e.Result(context.Background())
+		atomic.AddInt32(&d.inFlight, -1)
+	}()
+	return e, nil
+}
+
+// InFlight returns the number of execs accepted via Put that have not
+// yet completed.
+func (d *drainingExecutor) InFlight() int {
+	return int(atomic.LoadInt32(&d.inFlight))
+}
+
+// RecentPuts returns the number of execs accepted via Put within the
+// last window, pruning older entries as a side effect so the
+// bookkeeping doesn't grow unboundedly over the reflowlet's lifetime.
+func (d *drainingExecutor) RecentPuts(window time.Duration) int {
+	return pruneAndCount(&d.mu, &d.puts, window, time.Now())
+}
+
+// pruneAndCount drops entries in *times older than now-window and
+// returns the number that remain. It is factored out of RecentPuts so
+// it can be unit tested without a *local.Pool.
+func pruneAndCount(mu *sync.Mutex, times *[]time.Time, window time.Duration, now time.Time) int {
+	cutoff := now.Add(-window)
+	mu.Lock()
+	defer mu.Unlock()
+	i := 0
+	for i < len(*times) && (*times)[i].Before(cutoff) {
+		i++
+	}
+	*times = (*times)[i:]
+	return len(*times)
+}
+
+// IdlePolicy decides whether an EC2Cluster reflowlet that is not
+// currently running any execs should begin shutting down. It is
+// polled periodically by ListenAndServe's idle-shutdown loop.
+type IdlePolicy interface {
+	// ShouldShutdown reports whether the reflowlet should begin its
+	// shutdown drain now, given p's current and recent activity.
+	ShouldShutdown(p *drainingExecutor) bool
+}
+
+// FixedExpiry is the original idle-shutdown policy: shut down once
+// the pool has been idle continuously for Expiry.
+type FixedExpiry struct {
+	Expiry time.Duration
+}
+
+// ShouldShutdown implements IdlePolicy.
+func (f FixedExpiry) ShouldShutdown(p *drainingExecutor) bool {
+	return p.StopIfIdleFor(f.Expiry)
+}
+
+// BillingAligned shuts down only within Margin of the next billing
+// tick (the next hourly or per-second increment, per Period),
+// rather than on a fixed schedule unrelated to what's actually being
+// paid for. MinIdle still guards against shutting down an instance
+// that only just went idle.
+type BillingAligned struct {
+	// Period is the billing increment, e.g. time.Hour for
+	// hourly-billed instance types or time.Second for per-second
+	// billing.
+	Period time.Duration
+	// Margin is how close to the next billing tick the reflowlet
+	// must be before ShouldShutdown can return true.
+	Margin time.Duration
+	// MinIdle is the minimum time the pool must have been idle,
+	// independent of billing alignment.
+	MinIdle time.Duration
+
+	launch     time.Time
+	launchOnce bool
+}
+
+// ShouldShutdown implements IdlePolicy.
+func (b *BillingAligned) ShouldShutdown(p *drainingExecutor) bool {
+	if !p.StopIfIdleFor(b.MinIdle) {
+		return false
+	}
+	if !b.launchOnce {
+		b.launch = instanceLaunchTime()
+		b.launchOnce = true
+	}
+	return untilNextTick(b.Period, time.Since(b.launch)) <= b.Margin
+}
+
+// untilNextTick returns how long remains until elapsed next crosses a
+// multiple of period. It is factored out of ShouldShutdown so the
+// billing-alignment math can be unit tested without a *local.Pool.
+func untilNextTick(period, elapsed time.Duration) time.Duration {
+	return period - elapsed%period
+}
+
+// instanceLaunchTime returns the EC2 instance's launch time, as
+// reported in its identity document, falling back to the current
+// time (which disables billing alignment until the next restart of
+// this process) if the metadata service can't be reached, e.g.
+// because we're not actually running on EC2.
+func instanceLaunchTime() time.Time {
+	sess, err := session.NewSession()
+	if err != nil {
+		return time.Now()
+	}
+	doc, err := ec2metadata.New(sess).GetInstanceIdentityDocument()
+	if err != nil {
+		return time.Now()
+	}
+	return doc.PendingTime
+}
+
+// LoadAdaptive extends the idle expiry proportionally to how busy
+// the pool has recently been: a reflowlet that just finished a burst
+// of work is given more time to pick up the next one before it is
+// judged idle, up to MaxExpiry.
+type LoadAdaptive struct {
+	// BaseExpiry is the expiry used when there has been no recent
+	// throughput.
+	BaseExpiry time.Duration
+	// MaxExpiry bounds how far BaseExpiry can be extended.
+	MaxExpiry time.Duration
+	// Window is how far back recent throughput is measured over.
+	Window time.Duration
+}
+
+// ShouldShutdown implements IdlePolicy.
+func (l *LoadAdaptive) ShouldShutdown(p *drainingExecutor) bool {
+	n := p.RecentPuts(l.Window)
+	return p.StopIfIdleFor(adaptiveExpiry(l.BaseExpiry, l.MaxExpiry, n))
+}
+
+// adaptiveExpiry computes the idle expiry to apply given n execs
+// submitted within the recent window: each one earns the instance
+// another BaseExpiry of grace, capped at MaxExpiry. It is factored
+// out of ShouldShutdown so the scaling math can be unit tested
+// without a *local.Pool.
+func adaptiveExpiry(base, max time.Duration, n int) time.Duration {
+	if n <= 0 {
+		return base
+	}
+	if extended := base * time.Duration(1+n); extended <= max {
+		return extended
+	}
+	return max
+}
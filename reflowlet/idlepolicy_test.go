@@ -0,0 +1,62 @@
+// Copyright 2017 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package reflowlet
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPruneAndCount(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	var mu sync.Mutex
+	times := []time.Time{
+		now.Add(-20 * time.Minute),
+		now.Add(-9 * time.Minute),
+		now.Add(-1 * time.Minute),
+	}
+	if got, want := pruneAndCount(&mu, &times, 10*time.Minute, now), 2; got != want {
+		t.Errorf("got %d, want %d", got, want)
+	}
+	if got, want := len(times), 2; got != want {
+		t.Errorf("pruned slice length: got %d, want %d", got, want)
+	}
+	if got, want := pruneAndCount(&mu, &times, time.Minute, now), 1; got != want {
+		t.Errorf("got %d, want %d", got, want)
+	}
+}
+
+func TestAdaptiveExpiry(t *testing.T) {
+	const base, max = time.Minute, 10 * time.Minute
+	for _, c := range []struct {
+		n    int
+		want time.Duration
+	}{
+		{0, base},
+		{1, 2 * time.Minute},
+		{4, 5 * time.Minute},
+		{100, max},
+	} {
+		if got := adaptiveExpiry(base, max, c.n); got != c.want {
+			t.Errorf("adaptiveExpiry(%v, %v, %d): got %v, want %v", base, max, c.n, got, c.want)
+		}
+	}
+}
+
+func TestUntilNextTick(t *testing.T) {
+	for _, c := range []struct {
+		period, elapsed time.Duration
+		want            time.Duration
+	}{
+		{time.Hour, 0, time.Hour},
+		{time.Hour, 55 * time.Minute, 5 * time.Minute},
+		{time.Hour, 90 * time.Minute, 30 * time.Minute},
+	} {
+		if got := untilNextTick(c.period, c.elapsed); got != c.want {
+			t.Errorf("untilNextTick(%v, %v): got %v, want %v", c.period, c.elapsed, got, c.want)
+		}
+	}
+}
@@ -7,10 +7,13 @@ package reflowlet
 import (
 	"crypto/tls"
 	"flag"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strings"
 	"syscall"
 	"time"
 
@@ -22,6 +25,7 @@ import (
 	"github.com/grailbio/reflow/local"
 	"github.com/grailbio/reflow/log"
 	"github.com/grailbio/reflow/pool/server"
+	"github.com/grailbio/reflow/reflowlet/certstore"
 	repositoryhttp "github.com/grailbio/reflow/repository/http"
 	reflows3 "github.com/grailbio/reflow/repository/s3"
 	"github.com/grailbio/reflow/rest"
@@ -34,10 +38,25 @@ const maxConcurrentStreams = 20000
 
 // A Server is a reflow server, exposing a local pool over an HTTP server.
 type Server struct {
-	// The server's config.
-	// TODO(marius): move most of what is now flags here into the config.
+	// Config is used to resolve AWS credentials/session and the
+	// HTTPS certificate/client config (Config.AWS, Config.AWSCreds,
+	// Config.AWSTool, Config.HTTPS). Reflowlet's own settings below
+	// (Addr, Prefix, Dir, ...) are deliberately not part of Config's
+	// keyspace: that keyspace is a registry of named providers (aws,
+	// https, ...) shared across every Reflow binary, and reflowlet has
+	// no provider of that shape to register these under. cmd/reflowlet
+	// instead resolves them through its own flag/env/file precedence
+	// (see configSection there) and assigns the results directly to
+	// these fields.
 	Config config.Config
 
+	// Pool, when set, is used directly instead of one built from
+	// Config and a real Docker daemon, and Insecure must also be set.
+	// It exists for reflowlettest, which wires in a *local.Pool backed
+	// by a fake Docker daemon so that a real Server can be exercised
+	// in tests without either a Docker daemon or AWS credentials.
+	Pool *local.Pool
+
 	// Addr is the address on which to listen.
 	Addr string
 	// Prefix is the prefix used for directory lookup; permits reflowlet
@@ -55,11 +74,122 @@ type Server struct {
 	// HTTPDebug determines whether HTTP debug logging is turned on.
 	HTTPDebug bool
 
+	// CertMode selects how the server obtains its TLS certificate:
+	// the static cert returned by Config.HTTPS (the default), or one
+	// provisioned via ACME against the Let's Encrypt staging or
+	// production directory.
+	CertMode CertMode
+	// ACMEHosts is the set of DNS names the server will request ACME
+	// certificates for. It is required when CertMode is not
+	// CertModeStatic.
+	ACMEHosts []string
+	// CertStore persists the ACME account key and issued certificate
+	// chain. It defaults to a certstore.File rooted at Dir, but an
+	// EC2Cluster should set this to a shared backend (e.g.
+	// certstore.S3) so that every instance in the cluster serves the
+	// same certificate instead of each provisioning its own.
+	CertStore certstore.Store
+	// ACMERequireClientCert additionally requires callers to present a
+	// verified client certificate on ACME-provisioned listeners,
+	// matching CertModeStatic's default. It is off by default: Let's
+	// Encrypt's own validation requests can't present a client cert,
+	// so turning this on will break the TLS-ALPN-01 challenge (the
+	// HTTP-01 challenge is unaffected, since it isn't served over this
+	// listener). Only set it if ACME issuance is handled out-of-band,
+	// e.g. via DNS-01 or a separate HTTP-01 listener.
+	ACMERequireClientCert bool
+
+	// StreamBufferSize overrides the default 1 MiB WebSocket frame
+	// and read-buffer size used by the exec-log and flow-event
+	// streaming endpoints. It exists because long-running
+	// bioinformatics tools routinely emit log lines well beyond
+	// gorilla/websocket's 64KB default, which would otherwise
+	// silently truncate them.
+	StreamBufferSize int
+
+	// IdlePolicy decides when an EC2Cluster reflowlet should begin
+	// shutting down after it runs out of work. It defaults to
+	// FixedExpiry{Expiry: 10 * time.Minute}, matching the
+	// reflowlet's original, non-pluggable behavior.
+	IdlePolicy IdlePolicy
+	// DrainTimeout bounds how long an EC2Cluster reflowlet waits for
+	// in-flight execs to finish after IdlePolicy decides to shut
+	// down, before exiting regardless. It defaults to 10 minutes.
+	DrainTimeout time.Duration
+
 	configFlag string
+	acmeHosts  string
+
+	idlePolicyName                         string
+	idleExpiry, idleMaxExpiry, idleWindow time.Duration
+	billingPeriod, billingMargin          time.Duration
+}
+
+// idlePolicy returns s.IdlePolicy if set, otherwise builds one from
+// the flags registered by AddFlags (idlepolicy and friends).
+func (s *Server) idlePolicy() (IdlePolicy, error) {
+	if s.IdlePolicy != nil {
+		return s.IdlePolicy, nil
+	}
+	switch s.idlePolicyName {
+	case "", "fixed":
+		expiry := s.idleExpiry
+		if expiry == 0 {
+			expiry = 10 * time.Minute
+		}
+		return FixedExpiry{Expiry: expiry}, nil
+	case "billing-aligned":
+		return &BillingAligned{
+			Period:  s.billingPeriod,
+			Margin:  s.billingMargin,
+			MinIdle: time.Minute,
+		}, nil
+	case "load-adaptive":
+		return &LoadAdaptive{
+			BaseExpiry: s.idleExpiry,
+			MaxExpiry:  s.idleMaxExpiry,
+			Window:     s.idleWindow,
+		}, nil
+	default:
+		return nil, fmt.Errorf("reflowlet: unknown idle policy %q", s.idlePolicyName)
+	}
+}
+
+// String implements flag.Value so that CertMode can be set directly
+// from the command line.
+func (m *CertMode) String() string {
+	if m == nil {
+		return string(CertModeStatic)
+	}
+	return string(*m)
+}
+
+// Set implements flag.Value.
+func (m *CertMode) Set(s string) error {
+	switch CertMode(s) {
+	case CertModeStatic, CertModeACMEStaging, CertModeACMEProduction:
+		*m = CertMode(s)
+		return nil
+	default:
+		return fmt.Errorf("invalid cert mode %q", s)
+	}
+}
+
+// SetConfigFile sets the Reflow configuration file that will be read
+// and merged into Config on the next call to ListenAndServe. It is
+// the programmatic equivalent of the "config" flag registered by
+// AddFlags, and is what the cmd/reflowlet cobra command uses once it
+// has resolved the flag/env/config-file precedence for this field
+// itself.
+func (s *Server) SetConfigFile(path string) {
+	s.configFlag = path
 }
 
 // AddFlags adds flags configuring various Reflowlet parameters to
-// the provided FlagSet.
+// the provided FlagSet. It predates the cmd/reflowlet cobra command
+// and is kept as a thin compatibility shim for existing callers; new
+// entry points should prefer cmd/reflowlet, which additionally layers
+// in REFLOWLET_* environment variables and the Reflow config file.
 func (s *Server) AddFlags(flags *flag.FlagSet) {
 	flags.StringVar(&s.configFlag, "config", "", "the Reflow configuration file")
 	flags.StringVar(&s.Addr, "addr", ":9000", "HTTPS server address")
@@ -69,91 +199,152 @@ func (s *Server) AddFlags(flags *flag.FlagSet) {
 	flags.IntVar(&s.NDigest, "ndigest", 32, "number of allowable concurrent digest ops")
 	flags.BoolVar(&s.EC2Cluster, "ec2cluster", false, "this reflowlet is part of an ec2cluster")
 	flags.BoolVar(&s.HTTPDebug, "httpdebug", false, "turn on HTTP debug logging")
+	flags.Var(&s.CertMode, "certmode", "how to obtain the server's TLS certificate: \"\" (static, via Config.HTTPS), \"acme-staging\", or \"acme-production\"")
+	flags.StringVar(&s.acmeHosts, "acmehosts", "", "comma-separated DNS names to provision ACME certificates for; required when -certmode is set")
+	flags.BoolVar(&s.ACMERequireClientCert, "acmerequireclientcert", false, "also require a verified client certificate on ACME-provisioned listeners; breaks the TLS-ALPN-01 challenge, so only use it with out-of-band ACME issuance")
+	flags.IntVar(&s.StreamBufferSize, "streambufsize", defaultStreamBufferSize, "frame/buffer size, in bytes, for the exec-log and flow-event streaming endpoints")
+	flags.StringVar(&s.idlePolicyName, "idlepolicy", "fixed", `ec2cluster idle-shutdown policy: "fixed" (default), "billing-aligned", or "load-adaptive"`)
+	flags.DurationVar(&s.idleExpiry, "idleexpiry", 10*time.Minute, "base idle expiry for the \"fixed\" and \"load-adaptive\" idle policies")
+	flags.DurationVar(&s.idleMaxExpiry, "idlemaxexpiry", time.Hour, "maximum idle expiry for the \"load-adaptive\" idle policy")
+	flags.DurationVar(&s.idleWindow, "idlewindow", 10*time.Minute, "recent-throughput window for the \"load-adaptive\" idle policy")
+	flags.DurationVar(&s.billingPeriod, "billingperiod", time.Hour, "billing increment for the \"billing-aligned\" idle policy")
+	flags.DurationVar(&s.billingMargin, "billingmargin", 5*time.Minute, "how close to the next billing tick the \"billing-aligned\" idle policy waits for before allowing shutdown")
+	flags.DurationVar(&s.DrainTimeout, "draintimeout", 10*time.Minute, "how long an idle ec2cluster reflowlet waits for in-flight execs before shutting down regardless")
 }
 
 // ListenAndServe serves the Reflowlet server on the configured address.
 func (s *Server) ListenAndServe() error {
-	if s.configFlag != "" {
-		b, err := ioutil.ReadFile(s.configFlag)
-		if err != nil {
-			return err
-		}
-		if err := config.Unmarshal(b, s.Config.Keys()); err != nil {
-			return err
-		}
-	}
-	var err error
-	s.Config, err = config.Make(s.Config)
+	mux, tlsConfig, err := s.newMux()
 	if err != nil {
 		return err
 	}
-	addr := os.Getenv("DOCKER_HOST")
-	if addr == "" {
-		addr = "unix:///var/run/docker.sock"
-	}
-	client, err := dockerclient.NewClient(
-		addr, dockerclient.DefaultVersion,
-		nil, map[string]string{"user-agent": "reflow"})
-	if err != nil {
-		return err
+	httpServer := &http.Server{Addr: s.Addr, Handler: mux}
+	if s.Insecure {
+		return httpServer.ListenAndServe()
 	}
+	httpServer.TLSConfig = tlsConfig
+	http2.ConfigureServer(httpServer, &http2.Server{
+		MaxConcurrentStreams: maxConcurrentStreams,
+	})
+	return httpServer.ListenAndServeTLS("", "")
+}
 
-	sess, err := s.Config.AWS()
-	if err != nil {
-		return err
-	}
-	clientConfig, serverConfig, err := s.Config.HTTPS()
-	if err != nil {
-		return err
-	}
-	creds, err := s.Config.AWSCreds()
-	if err != nil {
-		return err
-	}
-	tool, err := s.Config.AWSTool()
-	if err != nil {
-		return err
-	}
+// Handler builds the reflowlet's HTTP handler (the REST pool API plus
+// the exec-log and flow-event streaming endpoints) without binding a
+// network listener. It is exported for reflowlettest, which serves it
+// from an httptest.Server instead of a real listener; ListenAndServe
+// itself uses newMux directly so it can also recover the TLS config.
+func (s *Server) Handler() (http.Handler, error) {
+	mux, _, err := s.newMux()
+	return mux, err
+}
 
-	// Default HTTPS and s3 clients for repository dialers.
-	// TODO(marius): handle this more elegantly, perhaps by
-	// avoiding global registration altogether.
-	reflows3.SetClient(s3.New(sess))
-	transport := &http.Transport{TLSClientConfig: clientConfig}
-	http2.ConfigureTransport(transport)
-	repositoryhttp.HTTPClient = &http.Client{Transport: transport}
-
-	lim := limiter.New()
-	lim.Release(s.NDigest)
-	p := &local.Pool{
-		Client:        client,
-		Dir:           s.Dir,
-		Prefix:        s.Prefix,
-		Authenticator: ec2authenticator.New(sess),
-		AWSImage:      tool,
-		AWSCreds:      creds,
-		Log:           log.Std.Tee(nil, "executor: "),
-		DigestLimiter: lim,
-	}
-	if err := p.Start(); err != nil {
-		return err
+// newMux does the setup ListenAndServe needs short of actually
+// binding a listener: resolving Config (unless Pool is set), starting
+// the pool, wiring up the idle-shutdown loop, and building the HTTP
+// handler and (when !Insecure) its TLS config.
+func (s *Server) newMux() (http.Handler, *tls.Config, error) {
+	var serverConfig *tls.Config
+	p := s.Pool
+	if p == nil {
+		if s.configFlag != "" {
+			b, err := ioutil.ReadFile(s.configFlag)
+			if err != nil {
+				return nil, nil, err
+			}
+			if err := config.Unmarshal(b, s.Config.Keys()); err != nil {
+				return nil, nil, err
+			}
+		}
+		var err error
+		s.Config, err = config.Make(s.Config)
+		if err != nil {
+			return nil, nil, err
+		}
+		addr := os.Getenv("DOCKER_HOST")
+		if addr == "" {
+			addr = "unix:///var/run/docker.sock"
+		}
+		client, err := dockerclient.NewClient(
+			addr, dockerclient.DefaultVersion,
+			nil, map[string]string{"user-agent": "reflow"})
+		if err != nil {
+			return nil, nil, err
+		}
+
+		sess, err := s.Config.AWS()
+		if err != nil {
+			return nil, nil, err
+		}
+		var clientConfig *tls.Config
+		clientConfig, serverConfig, err = s.Config.HTTPS()
+		if err != nil {
+			return nil, nil, err
+		}
+		creds, err := s.Config.AWSCreds()
+		if err != nil {
+			return nil, nil, err
+		}
+		tool, err := s.Config.AWSTool()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		// Default HTTPS and s3 clients for repository dialers.
+		// TODO(marius): handle this more elegantly, perhaps by
+		// avoiding global registration altogether.
+		reflows3.SetClient(s3.New(sess))
+		transport := &http.Transport{TLSClientConfig: clientConfig}
+		http2.ConfigureTransport(transport)
+		repositoryhttp.HTTPClient = &http.Client{Transport: transport}
+
+		lim := limiter.New()
+		lim.Release(s.NDigest)
+		p = &local.Pool{
+			Client:        client,
+			Dir:           s.Dir,
+			Prefix:        s.Prefix,
+			Authenticator: ec2authenticator.New(sess),
+			AWSImage:      tool,
+			AWSCreds:      creds,
+			Log:           log.Std.Tee(nil, "executor: "),
+			DigestLimiter: lim,
+		}
+		if err := p.Start(); err != nil {
+			return nil, nil, err
+		}
+	} else if !s.Insecure {
+		return nil, nil, fmt.Errorf("reflowlet: Pool override requires Insecure")
 	}
+	dp := &drainingExecutor{Pool: p}
 	if s.EC2Cluster {
+		policy, err := s.idlePolicy()
+		if err != nil {
+			return nil, nil, err
+		}
+		drainTimeout := s.DrainTimeout
+		if drainTimeout == 0 {
+			drainTimeout = 10 * time.Minute
+		}
 		go func() {
 			const (
 				period = time.Minute
-				expiry = 10 * time.Minute
+				grace  = 10 * time.Minute
 			)
-			// Always give the instance an expiry period to receive work,
-			// then check periodically if the instance has been idle for more
-			// than the expiry time.
-			time.Sleep(expiry)
-			for {
-				if p.StopIfIdleFor(expiry) {
-					log.Fatalf("reflowlet idle for %s; shutting down", expiry)
-				}
+			// Always give the instance a grace period to receive work
+			// before it's eligible to be judged idle at all.
+			time.Sleep(grace)
+			for !policy.ShouldShutdown(dp) {
 				time.Sleep(period)
 			}
+			log.Printf("reflowlet idle; draining before shutdown")
+			dp.startDraining()
+			deadline := time.Now().Add(drainTimeout)
+			for time.Now().Before(deadline) && dp.InFlight() > 0 {
+				time.Sleep(time.Second)
+			}
+			log.Printf("reflowlet drained; shutting down")
+			os.Exit(0)
 		}()
 	}
 
@@ -164,17 +355,49 @@ func (s *Server) ListenAndServe() error {
 		log.Std.Level = log.DebugLevel
 	}
 
-	http.Handle("/", rest.Handler(server.NewNode(p), httpLog))
-	server := &http.Server{Addr: s.Addr}
+	mux := http.NewServeMux()
+	mux.Handle("/", rest.Handler(server.NewNode(dp), httpLog))
+	// The streaming endpoints are registered on the same mux (and
+	// thus served behind the same listener and TLS config, including
+	// client-cert auth) as the REST pool API above, so they inherit
+	// the same identity model rather than needing their own.
+	streamLog := log.Std.Tee(nil, "stream: ")
+	mux.Handle("/execs/", newExecLogHandler(p, s.StreamBufferSize, streamLog))
+	mux.Handle("/flows/", newFlowEventHandler(s.StreamBufferSize, streamLog))
 	if s.Insecure {
-		return server.ListenAndServe()
+		return mux, nil, nil
 	}
-	serverConfig.ClientAuth = tls.RequireAndVerifyClientCert
-	server.TLSConfig = serverConfig
-	http2.ConfigureServer(server, &http2.Server{
-		MaxConcurrentStreams: maxConcurrentStreams,
-	})
-	return server.ListenAndServeTLS("", "")
+	if s.CertMode == CertModeStatic {
+		serverConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		return mux, serverConfig, nil
+	}
+	hosts := s.ACMEHosts
+	if len(hosts) == 0 {
+		hosts = strings.Split(s.acmeHosts, ",")
+	}
+	if len(hosts) == 0 || hosts[0] == "" {
+		return nil, nil, fmt.Errorf("reflowlet: -acmehosts must be set when -certmode=%s", s.CertMode)
+	}
+	store := s.CertStore
+	if store == nil {
+		store = certstore.File(filepath.Join(s.Dir, "acme"))
+	}
+	acmeConfig, err := acmeTLSConfig(s.CertMode, hosts, store)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Unlike CertModeStatic, mTLS isn't required by default here:
+	// ACME-provisioned certificates are served to the public internet
+	// so Let's Encrypt can complete its challenge, and TLS-ALPN-01
+	// can't complete if every connection (including its own
+	// validation request) must present a client cert.
+	// ACMERequireClientCert is the explicit opt-in for operators who
+	// have arranged ACME issuance out-of-band and still want mTLS
+	// enforced on the pool API itself.
+	if s.ACMERequireClientCert {
+		acmeConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return mux, acmeConfig, nil
 }
 
 // IgnoreSigpipe consumes (and ignores) SIGPIPE signals. As of Go
@@ -0,0 +1,282 @@
+// Copyright 2017 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package reflowlet
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/grailbio/base/digest"
+	"github.com/grailbio/reflow"
+	"github.com/grailbio/reflow/log"
+)
+
+// defaultStreamBufferSize is the default WebSocket frame and I/O
+// buffer size used by the streaming endpoints. gorilla/websocket
+// defaults to a 4KB read buffer and a 64KB hard message-size ceiling,
+// either of which will silently truncate a single stdout/stderr
+// frame from a long-running bioinformatics tool, which routinely
+// exceed 64KB.
+const defaultStreamBufferSize = 1 << 20 // 1 MiB
+
+// execPool is the subset of local.Pool that the exec-log streaming
+// handler needs.
+type execPool interface {
+	Get(ctx context.Context, id digest.Digest) (reflow.Exec, error)
+}
+
+// execLogHandler serves "/execs/{id}/logs/stream", streaming an
+// exec's stdout and stderr to a subscribed WebSocket client as the
+// exec runs.
+type execLogHandler struct {
+	pool       execPool
+	bufferSize int
+	log        *log.Logger
+}
+
+// newExecLogHandler returns a handler for the exec-log streaming
+// endpoint. bufferSize configures both the WebSocket frame size and
+// the chunk size used when reading from the exec's log, and defaults
+// to defaultStreamBufferSize when zero.
+func newExecLogHandler(pool execPool, bufferSize int, logger *log.Logger) http.Handler {
+	if bufferSize <= 0 {
+		bufferSize = defaultStreamBufferSize
+	}
+	return &execLogHandler{pool: pool, bufferSize: bufferSize, log: logger}
+}
+
+func (h *execLogHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id, ok := execLogID(r.URL.Path)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	dgst, err := digest.Parse(id)
+	if err != nil {
+		http.Error(w, "invalid exec id: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	ctx := r.Context()
+	e, err := h.pool.Get(ctx, dgst)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	rc, err := e.Logs(ctx, true, true, true)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rc.Close()
+
+	upgrader := websocket.Upgrader{
+		ReadBufferSize:  h.bufferSize,
+		WriteBufferSize: h.bufferSize,
+		CheckOrigin:     func(*http.Request) bool { return true },
+	}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		if h.log != nil {
+			h.log.Errorf("execlog: upgrade %s: %v", id, err)
+		}
+		return
+	}
+	defer conn.Close()
+
+	// A dead peer only surfaces once we try to write to it or it
+	// closes the connection; watch for the latter via a read
+	// goroutine, the same way flowEventHandler.ServeHTTP does. done
+	// closing triggers the deferred rc.Close above, which unblocks
+	// the log-reading goroutine below if it's parked in rc.Read
+	// waiting on a long-running exec.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	type chunk struct {
+		data []byte
+		err  error
+	}
+	chunks := make(chan chunk)
+	go func() {
+		buf := make([]byte, h.bufferSize)
+		for {
+			n, err := rc.Read(buf)
+			if n > 0 {
+				b := make([]byte, n)
+				copy(b, buf[:n])
+				select {
+				case chunks <- chunk{data: b}:
+				case <-done:
+					return
+				}
+			}
+			if err != nil {
+				select {
+				case chunks <- chunk{err: err}:
+				case <-done:
+				}
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case <-done:
+			return
+		case c := <-chunks:
+			if len(c.data) > 0 {
+				if werr := conn.WriteMessage(websocket.BinaryMessage, c.data); werr != nil {
+					return
+				}
+			}
+			if c.err != nil {
+				if c.err != io.EOF && h.log != nil {
+					h.log.Errorf("execlog: read %s: %v", id, c.err)
+				}
+				return
+			}
+		}
+	}
+}
+
+// execLogID extracts the {id} path parameter from a request for
+// "/execs/{id}/logs/stream".
+func execLogID(path string) (string, bool) {
+	const prefix, suffix = "/execs/", "/logs/stream"
+	if !strings.HasPrefix(path, prefix) || !strings.HasSuffix(path, suffix) {
+		return "", false
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(path, prefix), suffix), true
+}
+
+// flowEventHandler serves "/flows/{id}/events", multiplexing
+// flow-state transition events to subscribed WebSocket clients.
+//
+// Flow evaluation happens in the reflow client's reflow.Eval, not in
+// the reflowlet pool. Events passed to Publish are relayed to
+// subscribers, but nothing calls Publish: the handler that newMux
+// registers is not reachable from outside it, so clients subscribed to
+// "/flows/{id}/events" receive no events.
+type flowEventHandler struct {
+	bufferSize int
+	log        *log.Logger
+
+	mu   sync.Mutex
+	subs map[string][]chan []byte
+}
+
+// newFlowEventHandler returns a handler for the flow-event streaming
+// endpoint, analogous to newExecLogHandler.
+func newFlowEventHandler(bufferSize int, logger *log.Logger) *flowEventHandler {
+	if bufferSize <= 0 {
+		bufferSize = defaultStreamBufferSize
+	}
+	return &flowEventHandler{bufferSize: bufferSize, log: logger, subs: make(map[string][]chan []byte)}
+}
+
+// Publish delivers event to every client currently subscribed to
+// flow id. Slow subscribers drop events rather than block the
+// publisher.
+func (h *flowEventHandler) Publish(id string, event []byte) {
+	h.mu.Lock()
+	chans := h.subs[id]
+	h.mu.Unlock()
+	for _, c := range chans {
+		select {
+		case c <- event:
+		default:
+		}
+	}
+}
+
+func (h *flowEventHandler) subscribe(id string) chan []byte {
+	c := make(chan []byte, 64)
+	h.mu.Lock()
+	h.subs[id] = append(h.subs[id], c)
+	h.mu.Unlock()
+	return c
+}
+
+func (h *flowEventHandler) unsubscribe(id string, c chan []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	subs := h.subs[id]
+	for i, s := range subs {
+		if s == c {
+			h.subs[id] = append(subs[:i], subs[i+1:]...)
+			break
+		}
+	}
+}
+
+func (h *flowEventHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id, ok := flowEventID(r.URL.Path)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	upgrader := websocket.Upgrader{
+		ReadBufferSize:  h.bufferSize,
+		WriteBufferSize: h.bufferSize,
+		CheckOrigin:     func(*http.Request) bool { return true },
+	}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		if h.log != nil {
+			h.log.Errorf("flowevents: upgrade %s: %v", id, err)
+		}
+		return
+	}
+	defer conn.Close()
+
+	events := h.subscribe(id)
+	defer h.unsubscribe(id, events)
+	// A dead peer only surfaces once we try to write to it or it
+	// closes the connection; watch for the latter via a read goroutine.
+	// done (rather than closing events, or ranging over it) is what
+	// unblocks the loop below: a subscriber that never receives an
+	// event before the peer disconnects would otherwise range over
+	// events forever, leaking this goroutine and the socket.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			return
+		case event := <-events:
+			if err := conn.WriteMessage(websocket.TextMessage, event); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func flowEventID(path string) (string, bool) {
+	const prefix, suffix = "/flows/", "/events"
+	if !strings.HasPrefix(path, prefix) || !strings.HasSuffix(path, suffix) {
+		return "", false
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(path, prefix), suffix), true
+}
@@ -0,0 +1,99 @@
+// Copyright 2017 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package reflowlet
+
+import "testing"
+
+func TestExecLogID(t *testing.T) {
+	for _, c := range []struct {
+		path string
+		id   string
+		ok   bool
+	}{
+		{"/execs/abc123/logs/stream", "abc123", true},
+		{"/execs//logs/stream", "", true},
+		{"/execs/abc123/logs", "", false},
+		{"/flows/abc123/events", "", false},
+		{"", "", false},
+	} {
+		id, ok := execLogID(c.path)
+		if ok != c.ok || id != c.id {
+			t.Errorf("execLogID(%q) = %q, %v; want %q, %v", c.path, id, ok, c.id, c.ok)
+		}
+	}
+}
+
+func TestFlowEventID(t *testing.T) {
+	for _, c := range []struct {
+		path string
+		id   string
+		ok   bool
+	}{
+		{"/flows/abc123/events", "abc123", true},
+		{"/flows//events", "", true},
+		{"/flows/abc123", "", false},
+		{"/execs/abc123/logs/stream", "", false},
+		{"", "", false},
+	} {
+		id, ok := flowEventID(c.path)
+		if ok != c.ok || id != c.id {
+			t.Errorf("flowEventID(%q) = %q, %v; want %q, %v", c.path, id, ok, c.id, c.ok)
+		}
+	}
+}
+
+func TestFlowEventHandlerPublishSubscribe(t *testing.T) {
+	h := newFlowEventHandler(0, nil)
+
+	// Publish with no subscribers is a no-op, not a panic or a block.
+	h.Publish("flow1", []byte("ignored"))
+
+	c1 := h.subscribe("flow1")
+	c2 := h.subscribe("flow1")
+	other := h.subscribe("flow2")
+
+	h.Publish("flow1", []byte("event"))
+	for _, c := range []chan []byte{c1, c2} {
+		select {
+		case got := <-c:
+			if string(got) != "event" {
+				t.Errorf("got %q, want %q", got, "event")
+			}
+		default:
+			t.Error("subscriber did not receive published event")
+		}
+	}
+	select {
+	case got := <-other:
+		t.Errorf("subscriber to a different flow id received %q", got)
+	default:
+	}
+
+	h.unsubscribe("flow1", c1)
+	h.mu.Lock()
+	subs := h.subs["flow1"]
+	h.mu.Unlock()
+	if len(subs) != 1 || subs[0] != c2 {
+		t.Errorf("after unsubscribe, subs[flow1] = %v, want [c2]", subs)
+	}
+
+	// Unsubscribing a channel that isn't (or is no longer) present is
+	// a no-op.
+	h.unsubscribe("flow1", c1)
+}
+
+func TestFlowEventHandlerPublishDropsWhenFull(t *testing.T) {
+	h := newFlowEventHandler(0, nil)
+	c := h.subscribe("flow1")
+
+	// Publish should never block even if a subscriber's buffer fills
+	// up; slow subscribers drop events instead.
+	for i := 0; i < cap(c)+10; i++ {
+		h.Publish("flow1", []byte("event"))
+	}
+	if n := len(c); n != cap(c) {
+		t.Errorf("len(c) = %d, want %d (full, not blocked)", n, cap(c))
+	}
+}
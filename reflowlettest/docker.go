@@ -0,0 +1,178 @@
+// Copyright 2017 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package reflowlettest
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// fakeDocker is a fake Docker daemon exposing just the subset of the
+// Docker Engine API that local.Pool exercises: creating, starting,
+// waiting on, and tailing the logs of a container, plus image
+// inspection. Rather than faking the engine-api client interface
+// directly (which would need to track whichever concrete methods
+// that client happens to expose), it serves real HTTP so that the
+// genuine dockerclient.NewClient can be pointed at it, the same way
+// it would be pointed at dockerd.
+//
+// Containers aren't really containerized: "starting" one just runs
+// its Cmd directly on the test host (Cmd[0] as the program, the rest
+// as its arguments, with no shell) and captures the output. That's
+// enough to exercise local.Pool's exec lifecycle (cache hits,
+// argmap application, intern/extern) without requiring a Docker
+// daemon in CI, in the same spirit as etcd's functional tester moving
+// from external binaries to embedded instances.
+type fakeDocker struct {
+	*httptest.Server
+
+	nextID     int64
+	mu         sync.Mutex
+	containers map[string]*fakeContainer
+}
+
+type fakeContainer struct {
+	image string
+	cmd   []string
+
+	mu     sync.Mutex
+	out    bytes.Buffer
+	done   chan struct{}
+	status int64
+}
+
+// newFakeDocker starts a fake Docker daemon and returns it. Callers
+// should pass Close (embedded from httptest.Server) as cleanup.
+func newFakeDocker() *fakeDocker {
+	d := &fakeDocker{containers: make(map[string]*fakeContainer)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/containers/create", d.handleCreate)
+	mux.HandleFunc("/containers/", d.handleContainer)
+	mux.HandleFunc("/images/", d.handleImage)
+	d.Server = httptest.NewServer(mux)
+	return d
+}
+
+func (d *fakeDocker) handleCreate(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Image string
+		Cmd   []string
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	id := strconv.FormatInt(atomic.AddInt64(&d.nextID, 1), 16)
+	c := &fakeContainer{image: req.Image, cmd: req.Cmd, done: make(chan struct{})}
+	d.mu.Lock()
+	d.containers[id] = c
+	d.mu.Unlock()
+	writeJSON(w, map[string]interface{}{"Id": id, "Warnings": []string{}})
+}
+
+// CreateCount returns the number of containers created so far.
+func (d *fakeDocker) CreateCount() int64 {
+	return atomic.LoadInt64(&d.nextID)
+}
+
+func (d *fakeDocker) container(id string) *fakeContainer {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.containers[id]
+}
+
+func (d *fakeDocker) handleContainer(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, "/containers/")
+	parts := strings.SplitN(rest, "/", 2)
+	id := parts[0]
+	c := d.container(id)
+	if c == nil {
+		http.NotFound(w, r)
+		return
+	}
+	var action string
+	if len(parts) > 1 {
+		action = parts[1]
+	}
+	switch {
+	case action == "start":
+		go c.run()
+		w.WriteHeader(http.StatusNoContent)
+	case action == "wait":
+		<-c.done
+		writeJSON(w, map[string]interface{}{"StatusCode": c.status})
+	case strings.HasPrefix(action, "logs"):
+		<-c.done
+		c.mu.Lock()
+		frame(w, 1, c.out.Bytes())
+		c.mu.Unlock()
+	case action == "json":
+		<-c.done
+		writeJSON(w, map[string]interface{}{
+			"Id":    id,
+			"Image": c.image,
+			"State": map[string]interface{}{"Running": false, "ExitCode": c.status},
+		})
+	case action == "" && r.Method == http.MethodDelete:
+		d.mu.Lock()
+		delete(d.containers, id)
+		d.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (d *fakeDocker) handleImage(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/images/"), "/json")
+	writeJSON(w, map[string]interface{}{
+		"Id":     "sha256:" + fmt.Sprintf("%x", []byte(name)),
+		"Config": map[string]interface{}{"Image": name},
+	})
+}
+
+func (c *fakeContainer) run() {
+	defer close(c.done)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.cmd) == 0 {
+		return
+	}
+	cmd := exec.Command(c.cmd[0], c.cmd[1:]...)
+	cmd.Stdout = &c.out
+	cmd.Stderr = &c.out
+	if err := cmd.Run(); err != nil {
+		if exit, ok := err.(*exec.ExitError); ok {
+			c.status = int64(exit.ExitCode())
+		} else {
+			c.status = 1
+		}
+	}
+}
+
+// frame writes b as a single docker log frame multiplexed on stream
+// (1 for stdout, 2 for stderr), matching the framing that
+// github.com/docker/docker/pkg/stdcopy expects to demultiplex.
+func frame(w http.ResponseWriter, stream byte, b []byte) {
+	var hdr [8]byte
+	hdr[0] = stream
+	binary.BigEndian.PutUint32(hdr[4:], uint32(len(b)))
+	w.Write(hdr[:])
+	w.Write(b)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,103 @@
+// Copyright 2017 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+// Package reflowlettest provides an embedded, in-process reflowlet
+// for use in tests that need real execution semantics (cache hits,
+// intern/extern, exec argmap application) without requiring a Docker
+// daemon or network access on the test host.
+package reflowlettest
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+
+	dockerclient "github.com/docker/engine-api/client"
+	"github.com/grailbio/base/limiter"
+	"github.com/grailbio/reflow"
+	"github.com/grailbio/reflow/local"
+	"github.com/grailbio/reflow/log"
+	"github.com/grailbio/reflow/pool/client"
+	"github.com/grailbio/reflow/reflowlet"
+	reflows3 "github.com/grailbio/reflow/repository/s3"
+)
+
+// Session is an embedded reflowlet: a reflowlet.Server whose pool is
+// backed by a fake Docker daemon and a fake S3, exposed over the same
+// REST API and HTTP handler it serves in production, and dialed back
+// into a client that satisfies reflow.Executor.
+type Session struct {
+	// Executor is a pool client wired to the embedded reflowlet,
+	// suitable for reflow.EvalConfig.Executor.
+	Executor reflow.Executor
+
+	docker *fakeDocker
+	rest   *httptest.Server
+	dir    string
+}
+
+// New starts an embedded reflowlet backed by a tmpfs local.Pool, a
+// fake Docker daemon, and an in-memory S3 stub, and returns a Session
+// wired to it. Callers must call Close when done.
+func New() (*Session, error) {
+	dir, err := ioutil.TempDir("", "reflowlettest")
+	if err != nil {
+		return nil, err
+	}
+	docker := newFakeDocker()
+	dc, err := dockerclient.NewClient(docker.URL, dockerclient.DefaultVersion, nil, nil)
+	if err != nil {
+		docker.Close()
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	reflows3.SetClient(newFakeS3())
+
+	lim := limiter.New()
+	lim.Release(32)
+	p := &local.Pool{
+		Client:        dc,
+		Dir:           dir,
+		Log:           log.Std.Tee(nil, "executor: "),
+		DigestLimiter: lim,
+	}
+	if err := p.Start(); err != nil {
+		docker.Close()
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	srv := &reflowlet.Server{Pool: p, Dir: dir, Insecure: true}
+	handler, err := srv.Handler()
+	if err != nil {
+		docker.Close()
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	restServer := httptest.NewServer(handler)
+	cli := client.New(restServer.URL, restServer.Client(), log.Std.Tee(nil, "client: "))
+
+	return &Session{
+		Executor: cli,
+		docker:   docker,
+		rest:     restServer,
+		dir:      dir,
+	}, nil
+}
+
+// DockerCreateCount returns the number of containers the embedded
+// fake Docker daemon has created so far. Tests use it to tell whether
+// a flow evaluation actually ran an exec or was served out of cache.
+func (s *Session) DockerCreateCount() int64 {
+	return s.docker.CreateCount()
+}
+
+// Close tears down the embedded reflowlet and its fakes.
+func (s *Session) Close() {
+	s.rest.Close()
+	s.docker.Close()
+	os.RemoveAll(s.dir)
+}
@@ -0,0 +1,71 @@
+// Copyright 2017 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package reflowlettest
+
+import (
+	"bytes"
+	"io/ioutil"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// fakeS3 is an in-memory stand-in for the handful of S3 operations
+// reflows3 needs (get, put, head). It embeds s3iface.S3API so that it
+// satisfies the full interface without implementing the hundred-odd
+// methods reflow never calls; calling one of those would panic on
+// the nil embedded interface, which is an acceptable failure mode for
+// a test fake.
+type fakeS3 struct {
+	s3iface.S3API
+
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{objects: make(map[string][]byte)}
+}
+
+func (s *fakeS3) key(bucket, key string) string {
+	return bucket + "/" + key
+}
+
+func (s *fakeS3) GetObject(in *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.objects[s.key(aws.StringValue(in.Bucket), aws.StringValue(in.Key))]
+	if !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchKey, "no such key", nil)
+	}
+	return &s3.GetObjectOutput{
+		Body:          ioutil.NopCloser(bytes.NewReader(b)),
+		ContentLength: aws.Int64(int64(len(b))),
+	}, nil
+}
+
+func (s *fakeS3) PutObject(in *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	b, err := ioutil.ReadAll(in.Body)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	s.objects[s.key(aws.StringValue(in.Bucket), aws.StringValue(in.Key))] = b
+	s.mu.Unlock()
+	return &s3.PutObjectOutput{}, nil
+}
+
+func (s *fakeS3) HeadObject(in *s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.objects[s.key(aws.StringValue(in.Bucket), aws.StringValue(in.Key))]
+	if !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchKey, "no such key", nil)
+	}
+	return &s3.HeadObjectOutput{ContentLength: aws.Int64(int64(len(b)))}, nil
+}
@@ -8,6 +8,7 @@ import (
 	"bytes"
 	"context"
 	"errors"
+	"fmt"
 	"reflect"
 	"regexp"
 	"strings"
@@ -15,6 +16,7 @@ import (
 
 	"github.com/grailbio/base/digest"
 	"github.com/grailbio/reflow"
+	"github.com/grailbio/reflow/reflowlettest"
 	"github.com/grailbio/reflow/types"
 	"github.com/grailbio/reflow/values"
 )
@@ -211,21 +213,58 @@ Prog:
 		}
 	tests:
 		for _, test := range tests {
-			switch v := v.(values.Module)[test].(type) {
+			switch v.(values.Module)[test].(type) {
 			case *reflow.Flow:
-				// We have to evaluate the flow. We do so through a no-op executor.
-				eval := reflow.NewEval(v, reflow.EvalConfig{
-					Executor: nopexecutor{},
-				})
-				if err := eval.Do(context.Background()); err != nil {
-					t.Errorf("%s.%s: %v", prog, test, err)
+				// newFlow rebuilds the module (and with it, a fresh
+				// *reflow.Flow graph) on every call. reflow.Eval tracks
+				// evaluation state on the flow nodes themselves, so
+				// reusing one *reflow.Flow across multiple Do calls would
+				// let the first pass's state short-circuit the rest.
+				newFlow := func() (*reflow.Flow, error) {
+					mv, err := m.Make(sess, sess.Values)
+					if err != nil {
+						return nil, err
+					}
+					f, ok := mv.(values.Module)[test].(*reflow.Flow)
+					if !ok {
+						return nil, fmt.Errorf("%s.%s: expected *reflow.Flow", prog, test)
+					}
+					return f, nil
+				}
+				run := func(executor reflow.Executor) bool {
+					f, err := newFlow()
+					if err != nil {
+						t.Errorf("%s", err)
+						return false
+					}
+					return evalFlow(t, prog, test, f, executor)
+				}
+				// Run once through a no-op executor, which verifies the
+				// flow graph shape without touching any real executor...
+				if !run(nopexecutor{}) {
 					continue tests
 				}
-				if !eval.Value().(bool) {
-					t.Errorf("%s.%s failed", prog, test)
+				// ...and twice through an embedded reflowlet, which
+				// additionally exercises real execution semantics: cache
+				// hits, intern/extern, exec argmap application.
+				rt, err := reflowlettest.New()
+				if err != nil {
+					t.Errorf("%s.%s: start embedded reflowlet: %v", prog, test, err)
+					continue tests
+				}
+				run(rt.Executor)
+				created := rt.DockerCreateCount()
+				// A second run of a freshly-built flow for the same
+				// program should be served entirely out of the
+				// embedded reflowlet's cache, so it shouldn't create any
+				// new containers.
+				run(rt.Executor)
+				if got := rt.DockerCreateCount(); got != created {
+					t.Errorf("%s.%s: second run created %d new container(s), want a cache hit", prog, test, got-created)
 				}
+				rt.Close()
 			case bool:
-				if !v {
+				if !v.(values.Module)[test].(bool) {
 					t.Errorf("%s.%s failed", prog, test)
 				}
 			}
@@ -234,6 +273,21 @@ Prog:
 	}
 }
 
+// evalFlow evaluates flow v through executor and reports whether the
+// test passed, logging any failure against t.
+func evalFlow(t *testing.T, prog, test string, v *reflow.Flow, executor reflow.Executor) bool {
+	eval := reflow.NewEval(v, reflow.EvalConfig{Executor: executor})
+	if err := eval.Do(context.Background()); err != nil {
+		t.Errorf("%s.%s: %v", prog, test, err)
+		return false
+	}
+	if !eval.Value().(bool) {
+		t.Errorf("%s.%s failed", prog, test)
+		return false
+	}
+	return true
+}
+
 func TestEvalErr(t *testing.T) {
 	sess := NewSession()
 	for _, c := range []struct {